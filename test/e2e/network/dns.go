@@ -17,15 +17,22 @@ limitations under the License.
 package network
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2elog "k8s.io/kubernetes/test/e2e/framework/log"
+	e2eskipper "k8s.io/kubernetes/test/e2e/framework/skipper"
+	dnscollector "k8s.io/kubernetes/test/e2e/network/dns"
+	imageutils "k8s.io/kubernetes/test/utils/image"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
@@ -362,6 +369,234 @@ var _ = SIGDescribe("DNS", func() {
 		validateTargetedProbeOutput(f, pod3, []string{wheezyFileName, jessieFileName}, svc.Spec.ClusterIP)
 	})
 
+	/*
+		Testname: DNS, for chained ExternalName services
+		Description: Create a chain of two ExternalName services, the first pointing at the
+		second and the second pointing at a real hostname. A pod querying the first service's
+		name MUST receive the full CNAME chain in a single answer.
+	*/
+	ginkgo.It("should resolve full CNAME chains for chained ExternalName services", func() {
+		ginkgo.By("Creating a chain of externalName services")
+		realHostname := "www.example.com"
+
+		serviceBName := "dns-test-service-chain-b"
+		serviceB := framework.CreateServiceSpec(serviceBName, realHostname, false, nil)
+		_, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(serviceB)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create ExternalName service: %s", serviceBName)
+		defer func() {
+			ginkgo.By("deleting service B")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(serviceB.Name, nil)
+		}()
+
+		serviceBFQDN := fmt.Sprintf("%s.%s.svc.%s", serviceBName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+		serviceAName := "dns-test-service-chain-a"
+		serviceA := framework.CreateServiceSpec(serviceAName, serviceBFQDN, false, nil)
+		_, err = f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(serviceA)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create ExternalName service: %s", serviceAName)
+		defer func() {
+			ginkgo.By("deleting service A")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(serviceA.Name, nil)
+		}()
+
+		serviceAFQDN := fmt.Sprintf("%s.%s.svc.%s", serviceAName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+		jessieProbeCmd, jessieFileName := createFullAnswerProbeCommand(serviceAFQDN, "CNAME", "jessie")
+		ginkgo.By("Running this command on jessie: " + jessieProbeCmd + "\n")
+
+		ginkgo.By("creating a pod to probe the CNAME chain")
+		pod := createDNSPod(f.Namespace.Name, jessieProbeCmd, jessieProbeCmd, dnsTestPodHostName, dnsTestServiceName)
+
+		validateCNAMEChain(f, pod, jessieFileName, []string{serviceBFQDN + ".", realHostname + "."})
+	})
+
+	ginkgo.It("should provide one A record per endpoint and SRV targets for a multi-replica headless service", func() {
+		ginkgo.By("Creating a headless service backed by a 3-replica StatefulSet")
+		const replicas = 3
+		serviceName := "dns-test-service-multi-endpoint"
+		testServiceSelector := map[string]string{
+			"dns-test-multi-endpoint": "true",
+		}
+		headlessService := framework.CreateServiceSpec(serviceName, "", true, testServiceSelector)
+		headlessService.Spec.Ports = []v1.ServicePort{{Port: 80, Name: "http", Protocol: v1.ProtocolTCP}}
+		_, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(headlessService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create headless service: %s", serviceName)
+		defer func() {
+			ginkgo.By("deleting the headless service")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(headlessService.Name, nil)
+		}()
+
+		statefulSet := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: serviceName, Namespace: f.Namespace.Name},
+			Spec: appsv1.StatefulSetSpec{
+				ServiceName: serviceName,
+				Replicas:    func() *int32 { r := int32(replicas); return &r }(),
+				Selector:    &metav1.LabelSelector{MatchLabels: testServiceSelector},
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: testServiceSelector},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{
+								Name:  "webserver",
+								Image: imageutils.GetE2EImage(imageutils.Agnhost),
+								Args:  []string{"test-webserver"},
+								Ports: []v1.ContainerPort{{ContainerPort: 80}},
+							},
+						},
+					},
+				},
+			},
+		}
+		_, err = f.ClientSet.AppsV1().StatefulSets(f.Namespace.Name).Create(statefulSet)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create StatefulSet: %s", serviceName)
+		defer func() {
+			ginkgo.By("deleting the StatefulSet")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.AppsV1().StatefulSets(f.Namespace.Name).Delete(statefulSet.Name, nil)
+		}()
+
+		ginkgo.By("waiting for all replica endpoints to be populated")
+		podIPs := waitForEndpointCount(f, serviceName, replicas)
+
+		serviceFQDN := fmt.Sprintf("%s.%s.svc.%s", serviceName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+
+		ginkgo.By("asserting the service name resolves to exactly one A record per endpoint")
+		probeCmd, fileName := createDNSProbeCommand(serviceFQDN, queryTypeA, "service-a")
+		pod := createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result := validateDNSResultsStructured(f, pod, fileName)
+		validateServiceDNSEndpoints(result, podIPs)
+
+		ginkgo.By("asserting each per-pod record resolves to its own pod IP")
+		for i := 0; i < replicas; i++ {
+			podHostname := fmt.Sprintf("%s-%d", serviceName, i)
+			statefulPod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(podHostname, metav1.GetOptions{})
+			framework.ExpectNoError(err, "failed to get StatefulSet pod %s", podHostname)
+
+			podFQDN := fmt.Sprintf("%s.%s", podHostname, serviceFQDN)
+			probeCmd, fileName := createDNSProbeCommand(podFQDN, queryTypeA, podHostname)
+			pod := createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+			result := validateDNSResultsStructured(f, pod, fileName)
+			if len(result.Answers) != 1 {
+				framework.Failf("expected exactly one A record for %s, got %d: %+v", podFQDN, len(result.Answers), result.Answers)
+			}
+			if result.Answers[0].Value != statefulPod.Status.PodIP {
+				framework.Failf("expected %s to resolve to its own pod IP %s, got %s", podFQDN, statefulPod.Status.PodIP, result.Answers[0].Value)
+			}
+		}
+
+		ginkgo.By("asserting the SRV record returns one target per endpoint")
+		srvName := fmt.Sprintf("_http._tcp.%s", serviceFQDN)
+		probeCmd, fileName = createDNSProbeCommand(srvName, queryTypeSRV, "service-srv")
+		pod = createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result = validateDNSResultsStructured(f, pod, fileName)
+		if len(result.Answers) != replicas {
+			framework.Failf("expected %d SRV targets for %s, got %d: %+v", replicas, srvName, len(result.Answers), result.Answers)
+		}
+	})
+
+	ginkgo.It("should converge DNS answers for a headless service within the CoreDNS TTL after endpoint churn", func() {
+		const coreDNSTTL = 30 * time.Second
+		ginkgo.By("Creating a headless service with no endpoints yet")
+		serviceName := "dns-test-service-churn"
+		testServiceSelector := map[string]string{
+			"dns-test-churn": "true",
+		}
+		headlessService := framework.CreateServiceSpec(serviceName, "", true, testServiceSelector)
+		_, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(headlessService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create headless service: %s", serviceName)
+		defer func() {
+			ginkgo.By("deleting the headless service")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(headlessService.Name, nil)
+		}()
+
+		serviceFQDN := fmt.Sprintf("%s.%s.svc.%s", serviceName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+		const probeInterval, probeDuration = 2 * time.Second, 90 * time.Second
+		probeCmd, fileName := createDNSProbeSeriesCommand(serviceFQDN, queryTypeA, probeInterval, probeDuration, "churn")
+		pod := createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+
+		ginkgo.By("adding a backing pod shortly after the probe series starts")
+		backingPod := f.NewAgnhostPod(f.Namespace.Name, "pause")
+		backingPod.ObjectMeta.Labels = testServiceSelector
+		backingPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(backingPod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create backing pod")
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(backingPod.Name, metav1.NewDeleteOptions(0))
+		}()
+		gomega.Expect(f.WaitForPodRunning(backingPod.Name)).NotTo(gomega.HaveOccurred())
+
+		podIPs := waitForEndpointCount(f, serviceName, 1)
+		validateDNSConvergence(f, pod, fileName, podIPs, coreDNSTTL, probeInterval, probeDuration)
+	})
+
+	ginkgo.It("should not resolve a name before it is created, and should negatively cache for no longer than the SOA minimum TTL", func() {
+		serviceName := "not-yet-created"
+		missingName := fmt.Sprintf("%s.%s.svc.%s", serviceName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+
+		ginkgo.By("querying a name that does not exist yet")
+		probeCmd, fileName := createDNSProbeCommand(missingName, queryTypeA, "negative")
+		pod := createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result := validateDNSResultsStructured(f, pod, fileName)
+		if result.Rcode != "NXDOMAIN" {
+			framework.Failf("expected NXDOMAIN for %s before creation, got %s", missingName, result.Rcode)
+		}
+		if result.NegativeTTL <= 0 {
+			framework.Failf("expected a positive SOA minimum TTL in the NXDOMAIN response for %s, got %d", missingName, result.NegativeTTL)
+		}
+		negativeTTL := time.Duration(result.NegativeTTL) * time.Second
+
+		ginkgo.By("creating a headless service matching the probed name and asserting it isn't visible before the negative TTL elapses")
+		headlessService := framework.CreateServiceSpec(serviceName, "", true, map[string]string{"dns-test-negcache": "true"})
+		_, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(headlessService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create service: %s", serviceName)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(headlessService.Name, nil)
+		}()
+
+		time.Sleep(negativeTTL / 2)
+		probeCmd, fileName = createDNSProbeCommand(missingName, queryTypeA, "negative-midway")
+		pod = createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result = validateDNSResultsStructured(f, pod, fileName)
+		if result.Rcode != "NXDOMAIN" {
+			framework.Failf("expected the negative answer for %s to still be cached at half the SOA minimum TTL, got rcode %s", missingName, result.Rcode)
+		}
+
+		ginkgo.By("asserting resolution succeeds once the negative TTL has elapsed")
+		time.Sleep(negativeTTL/2 + 2*time.Second)
+		probeCmd, fileName = createDNSProbeCommand(missingName, queryTypeA, "negative-after-ttl")
+		pod = createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result = validateDNSResultsStructured(f, pod, fileName)
+		if result.Rcode != "NOERROR" {
+			framework.Failf("expected %s to resolve once the negative TTL elapsed, got rcode %s", missingName, result.Rcode)
+		}
+	})
+
+	ginkgo.It("should report NOERROR/NXDOMAIN rcodes via the structured DNS probe", func() {
+		ginkgo.By("probing a name that exists")
+		existingName := fmt.Sprintf("kubernetes.default.svc.%s", framework.TestContext.ClusterDNSDomain)
+		probeCmd, fileName := createDNSProbeCommand(existingName, queryTypeA, "exists")
+		pod := createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result := validateDNSResultsStructured(f, pod, fileName)
+		if result.Rcode != "NOERROR" {
+			framework.Failf("expected NOERROR resolving %s, got rcode %s (answers: %+v)", existingName, result.Rcode, result.Answers)
+		}
+		if len(result.Answers) == 0 {
+			framework.Failf("expected at least one answer resolving %s, got none", existingName)
+		}
+
+		ginkgo.By("probing a name that does not exist")
+		missingName := fmt.Sprintf("this-name-should-not-exist.%s", framework.TestContext.ClusterDNSDomain)
+		probeCmd, fileName = createDNSProbeCommand(missingName, queryTypeA, "missing")
+		pod = createDNSProbePod(f.Namespace.Name, probeCmd, dnsTestPodHostName, dnsTestServiceName)
+		result = validateDNSResultsStructured(f, pod, fileName)
+		if result.Rcode != "NXDOMAIN" {
+			framework.Failf("expected NXDOMAIN resolving %s, got rcode %s", missingName, result.Rcode)
+		}
+	})
+
 	ginkgo.It("should support configurable pod DNS nameservers", func() {
 		ginkgo.By("Creating a pod with dnsPolicy=None and customized dnsConfig...")
 		testServerIP := "1.1.1.1"
@@ -510,4 +745,524 @@ var _ = SIGDescribe("DNS", func() {
 		// TODO: Add more test cases for other DNSPolicies.
 	})
 
+	ginkgo.It("should support a dual-stack mix of IPv4 and IPv6 pod DNS nameservers", func() {
+		ginkgo.By("detecting whether the cluster advertises IPv6 Service addresses")
+		probeService := framework.CreateServiceSpec("dns-test-ipfamily-probe", "", false, nil)
+		probeService, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(probeService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create IP family probe service")
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(probeService.Name, nil)
+		}()
+		dualStackCluster := false
+		for _, family := range probeService.Spec.IPFamilies {
+			if family == v1.IPv6Protocol {
+				dualStackCluster = true
+			}
+		}
+		if !dualStackCluster {
+			e2eskipper.Skipf("cluster does not advertise IPv6 in Service.Spec.IPFamilies, skipping dual-stack resolv.conf assertions")
+		}
+
+		ginkgo.By("Preparing a dual-stack DNS server with both A and AAAA records injected...")
+		testSearchPath := "resolv.conf.local"
+		testDNSNameShort := "notexistname"
+		testDNSNameFull := fmt.Sprintf("%s.%s", testDNSNameShort, testSearchPath)
+		testInjectedIPv4 := "1.1.1.1"
+		testInjectedIPv6 := "2001:db8::1"
+
+		serverPod := generateDualStackDNSServerPod(map[string]string{testDNSNameFull: testInjectedIPv4}, map[string]string{testDNSNameFull: testInjectedIPv6})
+		serverPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(serverPod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", serverPod.Name)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(serverPod.Name, metav1.NewDeleteOptions(0))
+		}()
+		gomega.Expect(f.WaitForPodRunning(serverPod.Name)).NotTo(gomega.HaveOccurred())
+		serverPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(serverPod.Name, metav1.GetOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		serverIPv4 := serverPod.Status.PodIP
+		serverIPv6 := ""
+		for _, podIP := range serverPod.Status.PodIPs {
+			if strings.Contains(podIP.IP, ":") {
+				serverIPv6 = podIP.IP
+			}
+		}
+		if serverIPv6 == "" {
+			framework.Failf("DNS server pod %s has no IPv6 address in a dual-stack cluster: %v", serverPod.Name, serverPod.Status.PodIPs)
+		}
+
+		ginkgo.By("Creating a pod with dnsPolicy=None and a mix of v4/v6 nameservers...")
+		utilsPod := generateDNSUtilsPod()
+		utilsPod.Spec.DNSPolicy = v1.DNSNone
+		utilsPod.Spec.DNSConfig = &v1.PodDNSConfig{
+			Nameservers: []string{serverIPv4, serverIPv6},
+			Searches:    []string{testSearchPath},
+		}
+		utilsPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(utilsPod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", utilsPod.Name)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(utilsPod.Name, metav1.NewDeleteOptions(0))
+		}()
+		gomega.Expect(f.WaitForPodRunning(utilsPod.Name)).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("Verifying nameservers are listed in /etc/resolv.conf in the configured order...")
+		stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+			Command:       []string{"cat", "/etc/resolv.conf"},
+			Namespace:     f.Namespace.Name,
+			PodName:       utilsPod.Name,
+			ContainerName: "util",
+			CaptureStdout: true,
+			CaptureStderr: true,
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to read /etc/resolv.conf from pod %s", utilsPod.Name)
+		parsed := parseResolvConf(stdout)
+		if len(parsed.Nameservers) != 2 || parsed.Nameservers[0] != serverIPv4 || parsed.Nameservers[1] != serverIPv6 {
+			framework.Failf("expected nameservers [%s %s] in that order, got %v", serverIPv4, serverIPv6, parsed.Nameservers)
+		}
+
+		ginkgo.By("Verifying dig -4 resolves the injected A record...")
+		err = wait.PollImmediate(5*time.Second, 3*time.Minute, func() (bool, error) {
+			stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+				Command:       []string{"/usr/bin/dig", "-4", "+short", "+search", testDNSNameShort},
+				Namespace:     f.Namespace.Name,
+				PodName:       utilsPod.Name,
+				ContainerName: "util",
+				CaptureStdout: true,
+				CaptureStderr: true,
+			})
+			return err == nil && strings.TrimSpace(stdout) == testInjectedIPv4, nil
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to verify dig -4 resolves the IPv4 nameserver's answer")
+
+		ginkgo.By("Verifying dig -6 resolves the injected AAAA record...")
+		err = wait.PollImmediate(5*time.Second, 3*time.Minute, func() (bool, error) {
+			stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+				Command:       []string{"/usr/bin/dig", "-6", "+short", "+search", testDNSNameShort, "AAAA"},
+				Namespace:     f.Namespace.Name,
+				PodName:       utilsPod.Name,
+				ContainerName: "util",
+				CaptureStdout: true,
+				CaptureStderr: true,
+			})
+			return err == nil && strings.TrimSpace(stdout) == testInjectedIPv6, nil
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to verify dig -6 resolves the IPv6 nameserver's answer")
+
+		ginkgo.By("Verifying that an unreachable IPv6-only nameserver fails deterministically...")
+		v6OnlyPod := generateDNSUtilsPod()
+		v6OnlyPod.Spec.DNSPolicy = v1.DNSNone
+		v6OnlyPod.Spec.DNSConfig = &v1.PodDNSConfig{
+			Nameservers: []string{testInjectedIPv6},
+			Searches:    []string{testSearchPath},
+		}
+		v6OnlyPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(v6OnlyPod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", v6OnlyPod.Name)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(v6OnlyPod.Name, metav1.NewDeleteOptions(0))
+		}()
+		gomega.Expect(f.WaitForPodRunning(v6OnlyPod.Name)).NotTo(gomega.HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			_, _, err := f.ExecWithOptions(framework.ExecOptions{
+				Command:       []string{"/usr/bin/dig", "+time=3", "+tries=1", "+short", "+search", testDNSNameShort},
+				Namespace:     f.Namespace.Name,
+				PodName:       v6OnlyPod.Name,
+				ContainerName: "util",
+				CaptureStdout: true,
+				CaptureStderr: true,
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred(), "expected resolution against an unreachable IPv6-only nameserver to consistently fail")
+		}
+	})
+
+	ginkgo.It("should provide A and AAAA records for a dual-stack cluster ClusterIP service", func() {
+		ginkgo.By("detecting whether the cluster advertises IPv6 Service addresses")
+		probeService := framework.CreateServiceSpec("dns-test-ipfamily-probe-clusterip", "", false, nil)
+		probeService, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(probeService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create IP family probe service")
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(probeService.Name, nil)
+		}()
+		dualStackCluster := false
+		for _, family := range probeService.Spec.IPFamilies {
+			if family == v1.IPv6Protocol {
+				dualStackCluster = true
+			}
+		}
+		if !dualStackCluster {
+			e2eskipper.Skipf("cluster does not advertise IPv6 in Service.Spec.IPFamilies, skipping dual-stack ClusterIP assertions")
+		}
+
+		ginkgo.By("creating a dual-stack cluster IP service")
+		testServiceSelector := map[string]string{
+			"dns-test-dual-stack": "true",
+		}
+		serviceName := "dns-test-service-dual-stack"
+		dualStackService := framework.CreateServiceSpec(serviceName, "", false, testServiceSelector)
+		dualStackService.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+		dualStackService.Spec.IPFamilyPolicy = requireDualStack()
+		dualStackService, err = f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(dualStackService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create dual-stack service: %s", serviceName)
+		defer func() {
+			ginkgo.By("deleting the dual-stack service")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(dualStackService.Name, nil)
+		}()
+
+		hostFQDN := fmt.Sprintf("%s.%s.svc.%s", serviceName, f.Namespace.Name, framework.TestContext.ClusterDNSDomain)
+
+		ginkgo.By("verifying an A record resolves to a ClusterIP of the IPv4 family")
+		wheezyProbeCmd, wheezyFileName := createTargetedProbeCommand(hostFQDN, string(queryTypeA), "wheezy")
+		jessieProbeCmd, jessieFileName := createTargetedProbeCommand(hostFQDN, string(queryTypeA), "jessie")
+		pod := createDNSPod(f.Namespace.Name, wheezyProbeCmd, jessieProbeCmd, dnsTestPodHostName, dnsTestServiceName)
+		validateTargetedProbeOutput(f, pod, []string{wheezyFileName, jessieFileName}, dualStackService.Spec.ClusterIPs[0])
+
+		ginkgo.By("verifying an AAAA record resolves to a ClusterIP of the IPv6 family")
+		wheezyProbeCmd, wheezyFileName = createTargetedProbeCommand(hostFQDN, string(queryTypeAAAA), "wheezy")
+		jessieProbeCmd, jessieFileName = createTargetedProbeCommand(hostFQDN, string(queryTypeAAAA), "jessie")
+		pod = createDNSPod(f.Namespace.Name, wheezyProbeCmd, jessieProbeCmd, dnsTestPodHostName, dnsTestServiceName)
+		validateTargetedProbeOutput(f, pod, []string{wheezyFileName, jessieFileName}, dualStackService.Spec.ClusterIPs[1])
+	})
+
+	ginkgo.It("should provide A and AAAA records for each endpoint of a dual-stack headless service", func() {
+		ginkgo.By("detecting whether the cluster advertises IPv6 Service addresses")
+		probeService := framework.CreateServiceSpec("dns-test-ipfamily-probe-headless", "", false, nil)
+		probeService, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(probeService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create IP family probe service")
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(probeService.Name, nil)
+		}()
+		dualStackCluster := false
+		for _, family := range probeService.Spec.IPFamilies {
+			if family == v1.IPv6Protocol {
+				dualStackCluster = true
+			}
+		}
+		if !dualStackCluster {
+			e2eskipper.Skipf("cluster does not advertise IPv6 in Service.Spec.IPFamilies, skipping dual-stack headless assertions")
+		}
+
+		ginkgo.By("creating a dual-stack headless service")
+		testServiceSelector := map[string]string{
+			"dns-test-dual-stack-headless": "true",
+		}
+		serviceName := "dns-test-service-dual-stack-headless"
+		headlessService := framework.CreateServiceSpec(serviceName, "", true, testServiceSelector)
+		headlessService.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+		headlessService.Spec.IPFamilyPolicy = requireDualStack()
+		_, err = f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(headlessService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create dual-stack headless service: %s", serviceName)
+		defer func() {
+			ginkgo.By("deleting the dual-stack headless service")
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(headlessService.Name, nil)
+		}()
+
+		namesToResolve := []string{
+			fmt.Sprintf("%s.%s.svc.%s", headlessService.Name, f.Namespace.Name, framework.TestContext.ClusterDNSDomain),
+		}
+		wheezyAProbeCmd, wheezyAFileNames := createProbeCommandForType(namesToResolve, nil, "", "wheezy", f.Namespace.Name, framework.TestContext.ClusterDNSDomain, queryTypeA)
+		wheezyAAAAProbeCmd, wheezyAAAAFileNames := createProbeCommandForType(namesToResolve, nil, "", "wheezy", f.Namespace.Name, framework.TestContext.ClusterDNSDomain, queryTypeAAAA)
+		jessieAProbeCmd, jessieAFileNames := createProbeCommandForType(namesToResolve, nil, "", "jessie", f.Namespace.Name, framework.TestContext.ClusterDNSDomain, queryTypeA)
+		jessieAAAAProbeCmd, jessieAAAAFileNames := createProbeCommandForType(namesToResolve, nil, "", "jessie", f.Namespace.Name, framework.TestContext.ClusterDNSDomain, queryTypeAAAA)
+
+		ginkgo.By("creating a pod to probe both address families")
+		pod := createDNSPod(f.Namespace.Name, wheezyAProbeCmd+"; "+wheezyAAAAProbeCmd, jessieAProbeCmd+"; "+jessieAAAAProbeCmd, dnsTestPodHostName, dnsTestServiceName)
+		pod.ObjectMeta.Labels = testServiceSelector
+
+		allFileNames := append(wheezyAFileNames, wheezyAAAAFileNames...)
+		allFileNames = append(allFileNames, jessieAFileNames...)
+		allFileNames = append(allFileNames, jessieAAAAFileNames...)
+		validateDNSResults(f, pod, allFileNames)
+	})
+
+	ginkgo.It("should collect a structured DNS health report from inside the cluster", func() {
+		ginkgo.By("creating a service in this namespace to check same-namespace Service resolution")
+		healthCheckServiceName := "dns-test-service-health-check"
+		healthCheckService := framework.CreateServiceSpec(healthCheckServiceName, "", false, map[string]string{"dns-test-health-check": "true"})
+		_, err := f.ClientSet.CoreV1().Services(f.Namespace.Name).Create(healthCheckService)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create service: %s", healthCheckServiceName)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Services(f.Namespace.Name).Delete(healthCheckService.Name, nil)
+		}()
+
+		ginkgo.By("creating a pod to run the DNS health checks from")
+		utilsPod := generateDNSUtilsPod()
+		utilsPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(utilsPod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", utilsPod.Name)
+		defer func() {
+			defer ginkgo.GinkgoRecover()
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(utilsPod.Name, metav1.NewDeleteOptions(0))
+		}()
+		gomega.Expect(f.WaitForPodRunning(utilsPod.Name)).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("resolving the kube-dns/CoreDNS endpoints to check directly")
+		kubeDNSEndpoints, err := f.ClientSet.CoreV1().Endpoints(metav1.NamespaceSystem).Get("kube-dns", metav1.GetOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to get kube-dns endpoints")
+		var dnsEndpointIPs []string
+		for _, subset := range kubeDNSEndpoints.Subsets {
+			for _, addr := range subset.Addresses {
+				dnsEndpointIPs = append(dnsEndpointIPs, addr.IP)
+			}
+		}
+		gomega.Expect(dnsEndpointIPs).NotTo(gomega.BeEmpty(), "kube-dns has no endpoints")
+
+		// Added due to #8512. This is critical for GCE and GKE deployments; other providers
+		// (on-prem, air-gapped) may have no route to the public internet at all.
+		externalName := ""
+		if framework.ProviderIs("gce", "gke") {
+			externalName = "www.google.com"
+		}
+
+		report, err := dnscollector.Collect(utilsPod, "util", f.Namespace.Name, framework.TestContext.ClusterDNSDomain, v1.DNSClusterFirst, dnsEndpointIPs, externalName, healthCheckServiceName, f.ExecWithOptions)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to collect DNS health report")
+
+		reportJSON, err := json.MarshalIndent(report, "", "  ")
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		if framework.TestContext.ReportDir != "" {
+			path := filepath.Join(framework.TestContext.ReportDir, fmt.Sprintf("dns-health-%s.json", f.Namespace.Name))
+			gomega.Expect(ioutil.WriteFile(path, reportJSON, 0644)).NotTo(gomega.HaveOccurred(), "failed to write DNS health report to %s", path)
+		} else {
+			e2elog.Logf("DNS health report:\n%s", reportJSON)
+		}
+
+		for _, check := range report.Checks {
+			if check.Classification != dnscollector.ClassOK {
+				framework.Failf("DNS health check %q against resolver %q failed with classification %q: %s", check.Query, check.Resolver, check.Classification, check.Answer)
+			}
+		}
+	})
+
+	ginkgo.It("should sustain DNS resolution under parallel load without excessive latency or errors [Slow] [Serial]", func() {
+		ginkgo.By(fmt.Sprintf("running %d probe pods for %s at %d QPS each", *dnsLoadPods, dnsLoadDuration.String(), *dnsLoadQPS))
+		report := runDNSLoadTest(f)
+
+		e2elog.Logf("DNS load test: overall p99=%s, error rate=%.4f across %d pods", report.OverallP99, report.ErrorRate, len(report.Pods))
+
+		if report.ErrorRate > *dnsLoadErrorEpsilon {
+			framework.Failf("DNS load test error rate %.4f exceeds threshold %.4f", report.ErrorRate, *dnsLoadErrorEpsilon)
+		}
+		if report.OverallP99 > *dnsLoadP99Threshold {
+			framework.Failf("DNS load test p99 latency %s exceeds threshold %s", report.OverallP99, *dnsLoadP99Threshold)
+		}
+	})
+
+	ginkgo.Describe("DNSConfig edge cases", func() {
+		ginkgo.It("should fall through to the second nameserver when the first is unreachable", func() {
+			unreachableIP := "198.51.100.1" // TEST-NET-2, guaranteed unreachable.
+			testInjectedIP := "1.1.1.1"
+			testSearchPath := "resolv.conf.local"
+			testDNSNameShort := "fallthrough-target"
+			testDNSNameFull := fmt.Sprintf("%s.%s", testDNSNameShort, testSearchPath)
+
+			serverPod := generateDNSServerPod(map[string]string{testDNSNameFull: testInjectedIP})
+			serverPod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(serverPod)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create DNS server pod")
+			defer func() {
+				defer ginkgo.GinkgoRecover()
+				f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(serverPod.Name, metav1.NewDeleteOptions(0))
+			}()
+			gomega.Expect(f.WaitForPodRunning(serverPod.Name)).NotTo(gomega.HaveOccurred())
+			serverPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(serverPod.Name, metav1.GetOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			utilsPod := generateDNSUtilsPod()
+			utilsPod.Spec.DNSPolicy = v1.DNSNone
+			utilsPod.Spec.DNSConfig = &v1.PodDNSConfig{
+				Nameservers: []string{unreachableIP, serverPod.Status.PodIP},
+				Searches:    []string{testSearchPath},
+			}
+			utilsPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(utilsPod)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", utilsPod.Name)
+			defer func() {
+				defer ginkgo.GinkgoRecover()
+				f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(utilsPod.Name, metav1.NewDeleteOptions(0))
+			}()
+			gomega.Expect(f.WaitForPodRunning(utilsPod.Name)).NotTo(gomega.HaveOccurred())
+
+			digFunc := func() (bool, error) {
+				stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+					Command:       []string{"/usr/bin/dig", "+short", "+search", testDNSNameShort},
+					Namespace:     f.Namespace.Name,
+					PodName:       utilsPod.Name,
+					ContainerName: "util",
+					CaptureStdout: true,
+					CaptureStderr: true,
+				})
+				if err != nil {
+					return false, nil
+				}
+				return strings.TrimSpace(stdout) == testInjectedIP, nil
+			}
+			err = wait.PollImmediate(5*time.Second, 3*time.Minute, digFunc)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "expected fallthrough to the second nameserver to resolve %s", testDNSNameFull)
+		})
+
+		ginkgo.It("should reject search domains that exceed kubelet's length and count limits", func() {
+			// As of the resolver's historical limits: at most 6 search domains, and the
+			// concatenation of all search entries must not exceed 256 characters.
+			tooManySearches := make([]string, 7)
+			for i := range tooManySearches {
+				tooManySearches[i] = fmt.Sprintf("search-domain-%d.example.com", i)
+			}
+			pod := generateDNSUtilsPod()
+			pod.Spec.DNSPolicy = v1.DNSNone
+			pod.Spec.DNSConfig = &v1.PodDNSConfig{
+				Nameservers: []string{"1.1.1.1"},
+				Searches:    tooManySearches,
+			}
+			_, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+			gomega.Expect(err).To(gomega.HaveOccurred(), "expected the apiserver to reject a pod with more than 6 search domains")
+
+			longSearches := make([]string, 3)
+			for i := range longSearches {
+				longSearches[i] = fmt.Sprintf("%s.%s.example.com", strings.Repeat("a", 60), strings.Repeat(fmt.Sprintf("%d", i), 60))
+			}
+			longPod := generateDNSUtilsPod()
+			longPod.Spec.DNSPolicy = v1.DNSNone
+			longPod.Spec.DNSConfig = &v1.PodDNSConfig{
+				Nameservers: []string{"1.1.1.1"},
+				Searches:    longSearches,
+			}
+			_, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(longPod)
+			gomega.Expect(err).To(gomega.HaveOccurred(), "expected the apiserver to reject a pod whose search domains exceed 256 characters in total")
+		})
+
+		ginkgo.It("should reject DNSPolicy None without a DNSConfig, and reject a DNSConfig missing required fields", func() {
+			noConfigPod := generateDNSUtilsPod()
+			noConfigPod.Spec.DNSPolicy = v1.DNSNone
+			_, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(noConfigPod)
+			gomega.Expect(err).To(gomega.HaveOccurred(), "expected DNSPolicy: None without a DNSConfig to be rejected")
+
+			partialConfigPod := generateDNSUtilsPod()
+			partialConfigPod.Spec.DNSPolicy = v1.DNSNone
+			partialConfigPod.Spec.DNSConfig = &v1.PodDNSConfig{
+				// Neither Nameservers nor Searches set: nothing for the kubelet to inject.
+				Options: []v1.PodDNSConfigOption{{Name: "ndots", Value: func() *string { v := "2"; return &v }()}},
+			}
+			_, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(partialConfigPod)
+			gomega.Expect(err).To(gomega.HaveOccurred(), "expected DNSPolicy: None with only Options set to be rejected")
+		})
+
+		ginkgo.It("should support ClusterFirstWithHostNet on a hostNetwork pod", func() {
+			pod := generateDNSUtilsPod()
+			pod.Spec.HostNetwork = true
+			pod.Spec.DNSPolicy = v1.DNSClusterFirstWithHostNet
+			pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create hostNetwork pod: %s", pod.Name)
+			defer func() {
+				defer ginkgo.GinkgoRecover()
+				f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(pod.Name, metav1.NewDeleteOptions(0))
+			}()
+			gomega.Expect(f.WaitForPodRunning(pod.Name)).NotTo(gomega.HaveOccurred())
+
+			stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+				Command:       []string{"/usr/bin/dig", "+short", fmt.Sprintf("kubernetes.default.svc.%s", framework.TestContext.ClusterDNSDomain)},
+				Namespace:     f.Namespace.Name,
+				PodName:       pod.Name,
+				ContainerName: "util",
+				CaptureStdout: true,
+				CaptureStderr: true,
+			})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to resolve cluster DNS from a ClusterFirstWithHostNet pod")
+			gomega.Expect(stdout).NotTo(gomega.BeEmpty(), "expected a non-empty answer for kubernetes.default from a ClusterFirstWithHostNet pod")
+		})
+
+		// dnsConfigOptionCase exercises one merge/override combination between the
+		// cluster-injected resolv.conf and a pod's DNSConfig.Options.
+		type dnsConfigOptionCase struct {
+			name        string
+			options     []v1.PodDNSConfigOption
+			wantOptions map[string]string
+		}
+
+		ndotsOverride := "5"
+		timeoutOverride := "3"
+		attemptsOverride := "4"
+		cases := []dnsConfigOptionCase{
+			{
+				name: "ndots overrides the cluster default rather than appending",
+				options: []v1.PodDNSConfigOption{
+					{Name: "ndots", Value: &ndotsOverride},
+				},
+				wantOptions: map[string]string{"ndots": ndotsOverride},
+			},
+			{
+				name: "edns0 is appended as a bare option alongside the cluster defaults",
+				options: []v1.PodDNSConfigOption{
+					{Name: "edns0"},
+				},
+				wantOptions: map[string]string{"edns0": ""},
+			},
+			{
+				name: "timeout and attempts both override their cluster defaults",
+				options: []v1.PodDNSConfigOption{
+					{Name: "timeout", Value: &timeoutOverride},
+					{Name: "attempts", Value: &attemptsOverride},
+				},
+				wantOptions: map[string]string{"timeout": timeoutOverride, "attempts": attemptsOverride},
+			},
+		}
+
+		for _, tc := range cases {
+			tc := tc
+			ginkgo.It(fmt.Sprintf("should merge pod DNSConfig.Options into resolv.conf: %s", tc.name), func() {
+				pod := generateDNSUtilsPod()
+				pod.Spec.DNSPolicy = v1.DNSClusterFirst
+				pod.Spec.DNSConfig = &v1.PodDNSConfig{Options: tc.options}
+				pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to create pod: %s", pod.Name)
+				defer func() {
+					defer ginkgo.GinkgoRecover()
+					f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(pod.Name, metav1.NewDeleteOptions(0))
+				}()
+				gomega.Expect(f.WaitForPodRunning(pod.Name)).NotTo(gomega.HaveOccurred())
+
+				stdout, _, err := f.ExecWithOptions(framework.ExecOptions{
+					Command:       []string{"cat", "/etc/resolv.conf"},
+					Namespace:     f.Namespace.Name,
+					PodName:       pod.Name,
+					ContainerName: "util",
+					CaptureStdout: true,
+					CaptureStderr: true,
+				})
+				gomega.Expect(err).NotTo(gomega.HaveOccurred(), "failed to read /etc/resolv.conf from pod %s", pod.Name)
+
+				parsed := parseResolvConf(stdout)
+				for wantKey, wantValue := range tc.wantOptions {
+					gotValue, ok := parsed.Options[wantKey]
+					if !ok {
+						framework.Failf("expected option %q in merged resolv.conf, got %+v", wantKey, parsed.Options)
+					}
+					if gotValue != wantValue {
+						framework.Failf("expected option %q to be %q, got %q (full resolv.conf: %+v)", wantKey, wantValue, gotValue, parsed)
+					}
+					// parsed.Options keeps only the last value of a repeated option, so count
+					// occurrences in the raw file to tell an override apart from an append.
+					occurrences := 0
+					for _, line := range strings.Split(stdout, "\n") {
+						fields := strings.Fields(line)
+						if len(fields) == 0 || fields[0] != "options" {
+							continue
+						}
+						for _, opt := range fields[1:] {
+							if strings.SplitN(opt, ":", 2)[0] == wantKey {
+								occurrences++
+							}
+						}
+					}
+					if occurrences != 1 {
+						framework.Failf("expected option %q exactly once in merged resolv.conf, found it %d times: %s", wantKey, occurrences, stdout)
+					}
+				}
+			})
+		}
+	})
+
 })
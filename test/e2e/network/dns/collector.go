@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dns provides a reusable, in-cluster DNS health collector. It is modeled on the active
+// DNS checks a cluster-diagnostic tool would run: resolve a canonical set of names, compare the
+// pod's resolv.conf against what the kubelet should have injected for its DNSPolicy, and query
+// the cluster DNS service's endpoints directly to tell routing failures apart from upstream
+// resolver failures. Other network e2e tests can call Collect when they need to explain a
+// DNS-adjacent flake instead of just failing with "lookup timed out".
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// Classification buckets a single check's outcome so callers and humans reading the report can
+// scan for a failure mode without re-deriving it from raw output.
+type Classification string
+
+const (
+	ClassOK                  Classification = "ok"
+	ClassNXDomain            Classification = "nxdomain"
+	ClassServfail            Classification = "servfail"
+	ClassTimeout             Classification = "timeout"
+	ClassSearchMisconfig     Classification = "search-misconfig"
+	ClassEndpointUnreachable Classification = "endpoint-unreachable"
+)
+
+// CheckResult is one entry in a Report: the query that was made, which resolver answered it (or
+// was supposed to), how long it took, what came back, and its Classification.
+type CheckResult struct {
+	Query          string         `json:"query"`
+	Resolver       string         `json:"resolver"`
+	Latency        time.Duration  `json:"latencyNanos"`
+	Answer         string         `json:"answer"`
+	Classification Classification `json:"classification"`
+}
+
+// Report is the structured, JSON-serializable result of a full Collect run.
+type Report struct {
+	PodName string        `json:"podName"`
+	Checks  []CheckResult `json:"checks"`
+}
+
+// execFunc matches framework.Framework.ExecWithOptions closely enough for Collect to be unit
+// testable without a live cluster, while production callers just pass f.ExecWithOptions.
+type execFunc func(framework.ExecOptions) (string, string, error)
+
+// Collect runs the canonical DNS health checks against pod/containerName and returns a Report.
+// Check failures, including exec failures such as the pod disappearing, are recorded as
+// Classification values in the report; the returned error is always nil.
+//
+// dnsEndpointIPs are the pod IPs currently backing the cluster's kube-dns/CoreDNS Service (i.e.
+// the kube-system kube-dns Endpoints, which the caller resolves via the API since this package has
+// no clientset of its own); checkClusterDNSEndpoint queries them directly to isolate upstream
+// resolver failures from Service routing failures. externalName is an internet-reachable name to
+// resolve as a check that egress DNS works at all; callers should leave it empty on providers (bare
+// metal, air-gapped) where that isn't a given, the same way dns.go itself gates its own external
+// lookups on framework.ProviderIs("gce", "gke"). inNamespaceServiceName is the name of a Service
+// the caller has already created in namespace, used to check same-namespace Service resolution
+// (<svc>.<namespace>.svc.<domain>) and, by its bare name, search-path completion; leave it empty
+// to skip those checks.
+func Collect(pod *v1.Pod, containerName, namespace, clusterDNSDomain string, policy v1.DNSPolicy, dnsEndpointIPs []string, externalName, inNamespaceServiceName string, exec execFunc) (*Report, error) {
+	report := &Report{PodName: pod.Name}
+
+	canonicalNames := []string{
+		fmt.Sprintf("kubernetes.default.svc.%s", clusterDNSDomain),
+	}
+	if inNamespaceServiceName != "" {
+		canonicalNames = append(canonicalNames, fmt.Sprintf("%s.%s.svc.%s", inNamespaceServiceName, namespace, clusterDNSDomain))
+	}
+	if externalName != "" {
+		canonicalNames = append(canonicalNames, externalName)
+	}
+	for _, name := range canonicalNames {
+		report.Checks = append(report.Checks, digCheck(pod, containerName, name, false, exec))
+	}
+	// A deliberately short, unqualified name, looked up with the pod's search list: only resolves
+	// if ndots/search-path completion against the pod's own namespace search domain is configured
+	// correctly.
+	if inNamespaceServiceName != "" {
+		report.Checks = append(report.Checks, digCheck(pod, containerName, inNamespaceServiceName, true, exec))
+	}
+
+	resolvConfCheck, _ := checkResolvConf(pod, containerName, namespace, clusterDNSDomain, policy, exec)
+	report.Checks = append(report.Checks, resolvConfCheck)
+
+	for _, ip := range dnsEndpointIPs {
+		report.Checks = append(report.Checks, checkClusterDNSEndpoint(pod, containerName, clusterDNSDomain, ip, exec))
+	}
+
+	return report, nil
+}
+
+func digCheck(pod *v1.Pod, containerName, name string, search bool, exec execFunc) CheckResult {
+	command := []string{"/usr/bin/dig", "+short", "+time=3", "+tries=1"}
+	if search {
+		command = append(command, "+search")
+	}
+	start := time.Now()
+	stdout, stderr, err := exec(framework.ExecOptions{
+		Command:       append(command, name),
+		Namespace:     pod.Namespace,
+		PodName:       pod.Name,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	latency := time.Since(start)
+
+	result := CheckResult{Query: name, Resolver: "pod-resolv.conf", Latency: latency}
+	switch {
+	case err != nil && strings.Contains(stderr, "timed out"):
+		result.Classification = ClassTimeout
+	case err != nil:
+		result.Classification = ClassServfail
+		result.Answer = stderr
+	case strings.TrimSpace(stdout) == "":
+		result.Classification = ClassNXDomain
+	default:
+		result.Classification = ClassOK
+		result.Answer = strings.TrimSpace(stdout)
+	}
+	return result
+}
+
+// checkResolvConf reads /etc/resolv.conf from the pod and checks its search path against what
+// the kubelet injects for the given DNSPolicy, returning a CheckResult plus the parsed search
+// path. For ClusterFirst and ClusterFirstWithHostNet it checks only that the first search domain
+// starts with the pod's namespace; ndots and nameserver entries are not compared, and other
+// policies are always classified ok.
+func checkResolvConf(pod *v1.Pod, containerName, namespace, clusterDNSDomain string, policy v1.DNSPolicy, exec execFunc) (CheckResult, []string) {
+	stdout, _, err := exec(framework.ExecOptions{
+		Command:       []string{"cat", "/etc/resolv.conf"},
+		Namespace:     pod.Namespace,
+		PodName:       pod.Name,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	result := CheckResult{Query: "/etc/resolv.conf", Resolver: "local"}
+	if err != nil {
+		result.Classification = ClassServfail
+		return result, nil
+	}
+
+	var search []string
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "search" {
+			search = append(search, fields[1:]...)
+		}
+	}
+
+	switch policy {
+	case v1.DNSClusterFirst, v1.DNSClusterFirstWithHostNet:
+		if len(search) == 0 || !strings.HasPrefix(search[0], namespace) {
+			result.Classification = ClassSearchMisconfig
+			result.Answer = stdout
+			return result, search
+		}
+	}
+	result.Classification = ClassOK
+	result.Answer = stdout
+	return result, search
+}
+
+// checkClusterDNSEndpoint queries one kube-dns/CoreDNS pod directly by its IP address (resolved by
+// the caller from the kube-system kube-dns Endpoints, not by name), bypassing the Service VIP,
+// kube-proxy routing, and the pod's own resolver entirely, so a failure here points at that
+// specific DNS server pod rather than anything in between it and the querying pod.
+func checkClusterDNSEndpoint(pod *v1.Pod, containerName, clusterDNSDomain, dnsEndpointIP string, exec execFunc) CheckResult {
+	stdout, stderr, err := exec(framework.ExecOptions{
+		Command:       []string{"/usr/bin/dig", "+short", "+time=3", "+tries=1", "@" + dnsEndpointIP, "kubernetes.default.svc." + clusterDNSDomain},
+		Namespace:     pod.Namespace,
+		PodName:       pod.Name,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	result := CheckResult{Query: "kubernetes.default.svc via kube-dns endpoint directly", Resolver: dnsEndpointIP}
+	switch {
+	case err != nil && strings.Contains(stderr, "timed out"):
+		result.Classification = ClassTimeout
+	case err != nil || strings.TrimSpace(stdout) == "":
+		result.Classification = ClassEndpointUnreachable
+		result.Answer = stderr
+	default:
+		result.Classification = ClassOK
+		result.Answer = strings.TrimSpace(stdout)
+	}
+	return result
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	imageutils "k8s.io/kubernetes/test/utils/image"
+
+	"github.com/onsi/ginkgo"
+)
+
+// requireDualStack returns a pointer to v1.IPFamilyPolicyRequireDualStack, for assigning directly
+// to Service.Spec.IPFamilyPolicy.
+func requireDualStack() *v1.IPFamilyPolicyType {
+	policy := v1.IPFamilyPolicyRequireDualStack
+	return &policy
+}
+
+// dnsQueryType identifies the DNS RRType a probe command should look up. Callers that only care
+// about IPv4 addresses can keep using createProbeCommand, which defaults to "A".
+type dnsQueryType string
+
+const (
+	queryTypeA    dnsQueryType = "A"
+	queryTypeAAAA dnsQueryType = "AAAA"
+	queryTypeSRV  dnsQueryType = "SRV"
+)
+
+// createProbeCommand generates the shell command to probe DNS for the given namesToResolve and
+// hostEntries, and returns the command together with the list of file names the command will
+// write its results to. The probe pod exposes those files over HTTP so the test can scrape them
+// with validateDNSResults.
+func createProbeCommand(namesToResolve []string, hostEntries []string, subdomain, hostShortName, podNamespace, dnsDomain string) (string, []string) {
+	return createProbeCommandForType(namesToResolve, hostEntries, subdomain, hostShortName, podNamespace, dnsDomain, queryTypeA)
+}
+
+// createProbeCommandForType is like createProbeCommand but looks up the given record type for
+// every entry in namesToResolve, so callers can additionally assert on AAAA or SRV answers.
+// Names starting with "_" (SRV service names such as _http._tcp.<svc>) are always looked up as
+// SRV. Result file names carry hostShortName and queryType, so the files of different probers and
+// record types never collide.
+func createProbeCommandForType(namesToResolve []string, hostEntries []string, subdomain, hostShortName, podNamespace, dnsDomain string, queryType dnsQueryType) (string, []string) {
+	fileNamePrefix := fmt.Sprintf("%s_%s", hostShortName, queryType)
+	probeCmd := "for i in 0 1 2 3 4 5 6 7 8 9 10 11; do sleep 1; "
+	var fileNames []string
+	for _, name := range namesToResolve {
+		lookup := queryType
+		if strings.HasPrefix(name, "_") {
+			lookup = queryTypeSRV
+		}
+		fileName := fmt.Sprintf("%s_udp@%s", fileNamePrefix, name)
+		fileNames = append(fileNames, fileName)
+		probeCmd += fmt.Sprintf(`check="$(dig +notcp +noall +answer +search %s %s)" && test -n "$check" && echo OK > /results/%s;`, name, lookup, fileName)
+
+		fileName = fmt.Sprintf("%s_tcp@%s", fileNamePrefix, name)
+		fileNames = append(fileNames, fileName)
+		probeCmd += fmt.Sprintf(`check="$(dig +tcp +noall +answer +search %s %s)" && test -n "$check" && echo OK > /results/%s;`, name, lookup, fileName)
+	}
+
+	for _, name := range hostEntries {
+		fileName := fmt.Sprintf("%s_hosts@%s", fileNamePrefix, name)
+		fileNames = append(fileNames, fileName)
+		probeCmd += fmt.Sprintf(`getent hosts %s && echo OK > /results/%s;`, name, fileName)
+	}
+
+	probeCmd += "sleep 1; done"
+	return probeCmd, fileNames
+}
+
+// createTargetedProbeCommand generates a command that queries a single, fully-qualified hostFQDN
+// for the given queryType and captures the answer to a file retrieved by
+// validateTargetedProbeOutput.
+func createTargetedProbeCommand(hostFQDN, queryType, agnhostContainerName string) (string, string) {
+	fileName := fmt.Sprintf("%s_%s_udp@%s", hostFQDN, queryType, agnhostContainerName)
+	cmd := fmt.Sprintf("dig +notcp +noall +answer +search %s %s > /results/%s", hostFQDN, queryType, fileName)
+	return cmd, fileName
+}
+
+// createDNSPod builds a pod that runs the given wheezy/jessie probe commands and serves their
+// result files over HTTP for the test framework to scrape.
+func createDNSPod(namespace, wheezyProbeCmd, jessieProbeCmd, podHostName, serviceName string) *v1.Pod {
+	dnsPod := &v1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns-test-" + rand.String(5),
+			Namespace: namespace,
+		},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{
+					Name:         "results",
+					VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+				},
+			},
+			Containers: []v1.Container{
+				{
+					Name:         "webserver",
+					Image:        imageutils.GetE2EImage(imageutils.Agnhost),
+					Args:         []string{"test-webserver"},
+					Ports:        []v1.ContainerPort{{ContainerPort: 80}},
+					VolumeMounts: []v1.VolumeMount{{Name: "results", MountPath: "/results"}},
+				},
+				{
+					Name:         "jessie-querier",
+					Image:        imageutils.GetE2EImage(imageutils.JessieDnsutils),
+					Command:      []string{"sh", "-c", jessieProbeCmd},
+					VolumeMounts: []v1.VolumeMount{{Name: "results", MountPath: "/results"}},
+				},
+				{
+					Name:         "wheezy-querier",
+					Image:        imageutils.GetE2EImage(imageutils.DNSUtilsWheezy),
+					Command:      []string{"sh", "-c", wheezyProbeCmd},
+					VolumeMounts: []v1.VolumeMount{{Name: "results", MountPath: "/results"}},
+				},
+			},
+			RestartPolicy: v1.RestartPolicyNever,
+			Hostname:      podHostName,
+			Subdomain:     serviceName,
+		},
+	}
+	return dnsPod
+}
+
+// generateDNSServerPod returns a pod running a minimal DNS server that answers the given
+// aRecords (name -> IP) and nothing else, used to exercise custom dnsConfig.nameservers.
+func generateDNSServerPod(aRecords map[string]string) *v1.Pod {
+	args := []string{"dns-server"}
+	for name, ip := range aRecords {
+		args = append(args, fmt.Sprintf("--rr=%s:A:%s", name, ip))
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "dns-server-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "dns",
+					Image: imageutils.GetE2EImage(imageutils.Agnhost),
+					Args:  args,
+				},
+			},
+		},
+	}
+}
+
+// generateDualStackDNSServerPod is like generateDNSServerPod but additionally answers AAAA
+// queries for aaaaRecords, so dnsConfig.nameservers tests can inject both address families from
+// a single custom nameserver pod.
+func generateDualStackDNSServerPod(aRecords, aaaaRecords map[string]string) *v1.Pod {
+	args := []string{"dns-server"}
+	for name, ip := range aRecords {
+		args = append(args, fmt.Sprintf("--rr=%s:A:%s", name, ip))
+	}
+	for name, ip := range aaaaRecords {
+		args = append(args, fmt.Sprintf("--rr=%s:AAAA:%s", name, ip))
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "dns-server-dual-stack-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "dns",
+					Image: imageutils.GetE2EImage(imageutils.Agnhost),
+					Args:  args,
+				},
+			},
+		},
+	}
+}
+
+// generateDNSUtilsPod returns a pod with dig/getent preinstalled, used as a client for
+// exercising pod-level DNS customization.
+func generateDNSUtilsPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "dns-utils-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:    "util",
+					Image:   imageutils.GetE2EImage(imageutils.JessieDnsutils),
+					Command: []string{"sleep", "10000"},
+				},
+			},
+		},
+	}
+}
+
+// validateDNSResults creates pod, waits for it to run, and polls until every file in fileNames
+// exists, deleting the pod afterwards.
+func validateDNSResults(f *framework.Framework, pod *v1.Pod, fileNames []string) {
+	runProbePod(f, pod, fileNames, "")
+}
+
+// validateTargetedProbeOutput creates pod, waits for it to run, and polls until every result
+// file in fileNames contains expectedOutput, deleting the pod afterwards.
+func validateTargetedProbeOutput(f *framework.Framework, pod *v1.Pod, fileNames []string, expectedOutput string) {
+	runProbePod(f, pod, fileNames, expectedOutput)
+}
+
+// runProbePod creates the probe pod, waits for the expected result files to appear via the pod's
+// HTTP proxy, and optionally checks their content against expectedOutput (skipped when empty).
+func runProbePod(f *framework.Framework, pod *v1.Pod, fileNames []string, expectedOutput string) {
+	ginkgo.By("submitting the pod to kubernetes")
+	podClient := f.ClientSet.CoreV1().Pods(f.Namespace.Name)
+	defer func() {
+		ginkgo.By("deleting the pod")
+		defer ginkgo.GinkgoRecover()
+		podClient.Delete(pod.Name, metav1.NewDeleteOptions(0))
+	}()
+	if _, err := podClient.Create(pod); err != nil {
+		framework.Failf("ginkgo.Failed to create pod %s: %v", pod.Name, err)
+	}
+
+	framework.ExpectNoError(f.WaitForPodRunning(pod.Name))
+
+	ginkgo.By("retrieving the pod")
+	retrievedPod, err := podClient.Get(pod.Name, metav1.GetOptions{})
+	if err != nil {
+		framework.Failf("ginkgo.Failed to get pod %s: %v", pod.Name, err)
+	}
+
+	ginkgo.By("looking for the results for each expected name from probers")
+	assertFilesContain(fileNames, "results", retrievedPod, f.ClientSet, expectedOutput)
+}
+
+// resolvConf is a structured view of a parsed /etc/resolv.conf, used so DNSConfig merge/override
+// tests can assert on exact values instead of doing substring matches that miss ordering or
+// duplicate-entry regressions.
+type resolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     map[string]string
+}
+
+// parseResolvConf parses the contents of a resolv.conf file into a resolvConf. Unrecognized
+// directives are ignored, matching glibc's resolver behavior.
+func parseResolvConf(content string) resolvConf {
+	result := resolvConf{Options: map[string]string{}}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) >= 2 {
+				result.Nameservers = append(result.Nameservers, fields[1])
+			}
+		case "search":
+			result.Search = append(result.Search, fields[1:]...)
+		case "options":
+			for _, opt := range fields[1:] {
+				if kv := strings.SplitN(opt, ":", 2); len(kv) == 2 {
+					result.Options[kv[0]] = kv[1]
+				} else {
+					result.Options[opt] = ""
+				}
+			}
+		}
+	}
+	return result
+}
+
+// waitForEndpointCount polls until the Endpoints object for serviceName has exactly wantCount
+// addresses across all of its subsets, returning the list of addresses found.
+func waitForEndpointCount(f *framework.Framework, serviceName string, wantCount int) []string {
+	var addresses []string
+	framework.ExpectNoError(wait.PollImmediate(2*time.Second, 2*time.Minute, func() (bool, error) {
+		endpoints, err := f.ClientSet.CoreV1().Endpoints(f.Namespace.Name).Get(serviceName, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		addresses = nil
+		for _, subset := range endpoints.Subsets {
+			for _, addr := range subset.Addresses {
+				addresses = append(addresses, addr.IP)
+			}
+		}
+		return len(addresses) == wantCount, nil
+	}))
+	return addresses
+}
+
+// validateServiceDNSEndpoints asserts that the A answers in result contain exactly one record
+// for each address in wantIPs, independent of order.
+func validateServiceDNSEndpoints(result *dnsProbeResult, wantIPs []string) {
+	if len(result.Answers) != len(wantIPs) {
+		framework.Failf("expected %d DNS answers matching endpoints %v, got %d: %+v", len(wantIPs), wantIPs, len(result.Answers), result.Answers)
+	}
+	remaining := map[string]bool{}
+	for _, ip := range wantIPs {
+		remaining[ip] = true
+	}
+	for _, answer := range result.Answers {
+		if !remaining[answer.Value] {
+			framework.Failf("unexpected DNS answer %s not present in endpoints %v", answer.Value, wantIPs)
+		}
+		delete(remaining, answer.Value)
+	}
+	if len(remaining) != 0 {
+		framework.Failf("endpoints missing from DNS answers: %v", remaining)
+	}
+}
+
+// createFullAnswerProbeCommand returns the same command as createTargetedProbeCommand, which
+// already keeps the entire "+noall +answer" section in the result file, so multi-record answers
+// such as a CNAME chain can be inspected in full.
+func createFullAnswerProbeCommand(hostFQDN, queryType, agnhostContainerName string) (string, string) {
+	return createTargetedProbeCommand(hostFQDN, queryType, agnhostContainerName)
+}
+
+// validateCNAMEChain fetches the named result file, parses the dig "+noall +answer" output it
+// contains, and asserts that the CNAME records it contains, in order, match wantChain exactly.
+//
+// dig answer lines have the form "<name> <ttl> IN <type> <target>". This intentionally doesn't
+// assert anything about the TTL on those records: Kubernetes has no mechanism for a Service to
+// request a specific DNS TTL from the cluster's DNS provider (no apiserver field, no
+// kubelet/CoreDNS wiring), so there is nothing here to assert against. Revisit once that plumbing
+// exists.
+func validateCNAMEChain(f *framework.Framework, pod *v1.Pod, fileName string, wantChain []string) {
+	runProbePod(f, pod, []string{fileName}, "")
+
+	contents, err := f.ClientSet.CoreV1().RESTClient().Get().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		SubResource("proxy").
+		Name(pod.Name).
+		Suffix("results", fileName).
+		Do().Raw()
+	framework.ExpectNoError(err, "failed to fetch CNAME chain probe result %s", fileName)
+
+	var gotChain []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[2] != "IN" || fields[3] != "CNAME" {
+			continue
+		}
+		gotChain = append(gotChain, fields[4])
+	}
+
+	if !reflect.DeepEqual(gotChain, wantChain) {
+		framework.Failf("unexpected CNAME chain for %s: got %v, want %v", fileName, gotChain, wantChain)
+	}
+}
+
+// assertFilesContain polls the probe pod's "results" directory, over the pod's proxy subresource,
+// until every named file exists. When expectedOutput is non-empty, it additionally asserts the
+// file's contents contain it.
+func assertFilesContain(fileNames []string, fileDir string, pod *v1.Pod, client clientset.Interface, expectedOutput string) {
+	var failed []string
+
+	framework.ExpectNoError(wait.Poll(time.Second*2, time.Minute*5, func() (bool, error) {
+		failed = []string{}
+		for _, fileName := range fileNames {
+			contents, err := client.CoreV1().RESTClient().Get().
+				Namespace(pod.Namespace).
+				Resource("pods").
+				SubResource("proxy").
+				Name(pod.Name).
+				Suffix(fileDir, fileName).
+				Do().Raw()
+			if err != nil {
+				failed = append(failed, fileName)
+				continue
+			}
+			if expectedOutput != "" && !strings.Contains(string(contents), expectedOutput) {
+				failed = append(failed, fileName)
+			}
+		}
+		if len(failed) == 0 {
+			return true, nil
+		}
+		framework.Logf("Lookups using %s failed for: %v\n", pod.Name, failed)
+		return false, nil
+	}))
+	if len(failed) != 0 {
+		framework.Failf("DNS probes using %s failed for: %v", pod.Name, failed)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+var (
+	dnsLoadPods         = flag.Int("dns-load-pods", 50, "number of probe pods to run concurrently for the DNS load test")
+	dnsLoadDuration     = flag.Duration("dns-load-duration", 2*time.Minute, "how long each DNS load probe pod resolves names for")
+	dnsLoadQPS          = flag.Int("dns-load-qps", 10, "target queries per second each DNS load probe pod issues for each name it resolves")
+	dnsLoadP99Threshold = flag.Duration("dns-load-p99-threshold", 200*time.Millisecond, "overall p99 DNS resolution latency the load test tolerates before failing")
+	dnsLoadErrorEpsilon = flag.Float64("dns-load-error-epsilon", 0.01, "fraction of DNS queries allowed to error before the load test fails")
+)
+
+// dnsLoadPodResult is the per-pod aggregate the load test computes from that pod's
+// dnsProbeSnapshot series: throughput, latency percentiles, and a count of answers by error
+// class (NXDOMAIN/SERVFAIL/timeout), so a CoreDNS regression under load shows up as a shift in
+// these numbers rather than a single pass/fail bit.
+type dnsLoadPodResult struct {
+	PodName     string         `json:"podName"`
+	QueriesSent int            `json:"queriesSent"`
+	QPS         float64        `json:"qps"`
+	P50         time.Duration  `json:"p50Nanos"`
+	P95         time.Duration  `json:"p95Nanos"`
+	P99         time.Duration  `json:"p99Nanos"`
+	ErrorCounts map[string]int `json:"errorCounts"`
+}
+
+// dnsLoadReport is the JSON artifact written for the DNS load test, one entry per probe pod plus
+// the cluster-wide rollup used for the pass/fail decision.
+type dnsLoadReport struct {
+	Pods       []dnsLoadPodResult `json:"pods"`
+	OverallP99 time.Duration      `json:"overallP99Nanos"`
+	ErrorRate  float64            `json:"errorRate"`
+}
+
+// runDNSLoadTest spins up *dnsLoadPods probe pods, each resolving a cluster-internal name (and, on
+// providers where that's expected to work, an external one too) at *dnsLoadQPS for
+// *dnsLoadDuration, then aggregates per-pod and overall stats.
+func runDNSLoadTest(f *framework.Framework) *dnsLoadReport {
+	clusterName := fmt.Sprintf("kubernetes.default.svc.%s", framework.TestContext.ClusterDNSDomain)
+	// Added due to #8512. This is critical for GCE and GKE deployments; other providers
+	// (on-prem, air-gapped) may have no route to the public internet at all, and probing one every
+	// QPS tick across every load pod would inflate ErrorRate for reasons unrelated to CoreDNS.
+	externalName := ""
+	if framework.ProviderIs("gce", "gke") {
+		externalName = "www.google.com"
+	}
+
+	pods := make([]*v1.Pod, 0, *dnsLoadPods)
+	podFileNames := make([][]string, 0, *dnsLoadPods)
+	for i := 0; i < *dnsLoadPods; i++ {
+		label := fmt.Sprintf("load-%d", i)
+		interval := time.Second / time.Duration(*dnsLoadQPS)
+		clusterCmd, clusterFile := createDNSProbeSeriesCommand(clusterName, queryTypeA, interval, *dnsLoadDuration, label+"-cluster")
+		probeCmd := clusterCmd
+		fileNames := []string{clusterFile}
+		if externalName != "" {
+			externalCmd, externalFile := createDNSProbeSeriesCommand(externalName, queryTypeA, interval, *dnsLoadDuration, label+"-external")
+			probeCmd += " & " + externalCmd
+			fileNames = append(fileNames, externalFile)
+		}
+		pod := createDNSProbePod(f.Namespace.Name, probeCmd+" & wait", dnsTestPodHostName, dnsTestServiceName)
+		pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+		framework.ExpectNoError(err, "failed to create DNS load probe pod %d", i)
+		pods = append(pods, pod)
+		podFileNames = append(podFileNames, fileNames)
+	}
+	defer func() {
+		for _, pod := range pods {
+			f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(pod.Name, metav1.NewDeleteOptions(0))
+		}
+	}()
+
+	for _, pod := range pods {
+		framework.ExpectNoError(f.WaitForPodRunning(pod.Name), "DNS load probe pod %s never became ready", pod.Name)
+	}
+
+	// Let the probes run for the full duration before scraping results.
+	time.Sleep(*dnsLoadDuration + 10*time.Second)
+
+	report := &dnsLoadReport{}
+	var allLatencies []time.Duration
+	totalQueries, totalErrors := 0, 0
+
+	for i, pod := range pods {
+		podResult := dnsLoadPodResult{PodName: pod.Name, ErrorCounts: map[string]int{}}
+		var podLatencies []time.Duration
+		for _, fileName := range podFileNames[i] {
+			contents, err := f.ClientSet.CoreV1().RESTClient().Get().
+				Namespace(pod.Namespace).Resource("pods").SubResource("proxy").
+				Name(pod.Name).Suffix("results", fileName).Do().Raw()
+			if err != nil {
+				continue
+			}
+			var snapshots []dnsProbeSnapshot
+			if err := json.Unmarshal(contents, &snapshots); err != nil {
+				continue
+			}
+			for _, snapshot := range snapshots {
+				totalQueries++
+				podResult.QueriesSent++
+				if snapshot.Result.Rcode != "NOERROR" {
+					totalErrors++
+					podResult.ErrorCounts[snapshot.Result.Rcode]++
+				}
+				latency := time.Duration(snapshot.Result.LatencyNanos)
+				podLatencies = append(podLatencies, latency)
+				allLatencies = append(allLatencies, latency)
+			}
+		}
+		sort.Slice(podLatencies, func(a, b int) bool { return podLatencies[a] < podLatencies[b] })
+		podResult.P50 = percentile(podLatencies, 0.50)
+		podResult.P95 = percentile(podLatencies, 0.95)
+		podResult.P99 = percentile(podLatencies, 0.99)
+		podResult.QPS = float64(podResult.QueriesSent) / dnsLoadDuration.Seconds()
+		report.Pods = append(report.Pods, podResult)
+	}
+
+	sort.Slice(allLatencies, func(a, b int) bool { return allLatencies[a] < allLatencies[b] })
+	report.OverallP99 = percentile(allLatencies, 0.99)
+	if totalQueries > 0 {
+		report.ErrorRate = float64(totalErrors) / float64(totalQueries)
+	}
+
+	if framework.TestContext.ReportDir != "" {
+		reportJSON, err := json.MarshalIndent(report, "", "  ")
+		framework.ExpectNoError(err)
+		path := filepath.Join(framework.TestContext.ReportDir, fmt.Sprintf("dns-load-%s.json", f.Namespace.Name))
+		framework.ExpectNoError(ioutil.WriteFile(path, reportJSON, 0644), "failed to write DNS load report to %s", path)
+	}
+
+	return report
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	imageutils "k8s.io/kubernetes/test/utils/image"
+
+	"github.com/onsi/ginkgo"
+)
+
+// dnsProbeAnswer is one resource record from a structured DNS probe's answer section.
+type dnsProbeAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   int    `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// dnsProbeResult is the JSON artifact written by the agnhost "dns-probe" subcommand for a single
+// query. It captures enough of the raw response (rcode, full answer set, transport) that tests
+// can assert on things shell `dig` parsing can't reliably give us, like NXDOMAIN vs SERVFAIL or
+// whether the reply arrived over TCP after truncation.
+type dnsProbeResult struct {
+	Question     string           `json:"question"`
+	QueryType    string           `json:"queryType"`
+	Rcode        string           `json:"rcode"`
+	Answers      []dnsProbeAnswer `json:"answers"`
+	ResponseSize int              `json:"responseSize"`
+	Transport    string           `json:"transport"`
+	// LatencyNanos is the wall-clock time the query itself took to complete, as measured by the
+	// prober, independent of how long a probe series has been running (see
+	// dnsProbeSnapshot.ElapsedSeconds for that).
+	LatencyNanos int64 `json:"latencyNanos"`
+	// NegativeTTL is the SOA minimum TTL returned in the authority section of an NXDOMAIN
+	// response, used to size negative-caching convergence windows. Zero when Rcode != NXDOMAIN.
+	NegativeTTL int    `json:"negativeTTL,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// dnsProbeSnapshot pairs a dnsProbeResult with the number of seconds elapsed since the probe
+// series started, so callers can reason about when, during a churn window, the answer changed.
+type dnsProbeSnapshot struct {
+	ElapsedSeconds int            `json:"elapsedSeconds"`
+	Result         dnsProbeResult `json:"result"`
+}
+
+// createDNSProbeCommand builds the agnhost invocation that resolves name as queryType and writes
+// a dnsProbeResult as JSON to /results/fileName, using the Go DNS client (github.com/miekg/dns)
+// built into the agnhost image rather than shelling out to dig/nslookup. It returns the command
+// and the result file name.
+func createDNSProbeCommand(name string, queryType dnsQueryType, resultLabel string) (string, string) {
+	fileName := fmt.Sprintf("dns-probe_%s@%s", queryType, resultLabel)
+	cmd := fmt.Sprintf("/agnhost dns-probe --name=%s --type=%s --out=/results/%s", name, queryType, fileName)
+	return cmd, fileName
+}
+
+// createDNSProbeSeriesCommand builds the agnhost invocation that resolves name as queryType once
+// every interval for the given duration, appending a dnsProbeSnapshot to a JSON array in
+// /results/fileName on every iteration. It's used to observe DNS answers converging after
+// endpoint churn, or negative answers flipping to positive once a record is created.
+func createDNSProbeSeriesCommand(name string, queryType dnsQueryType, interval, duration time.Duration, resultLabel string) (string, string) {
+	fileName := fmt.Sprintf("dns-probe-series_%s@%s", queryType, resultLabel)
+	cmd := fmt.Sprintf("/agnhost dns-probe --name=%s --type=%s --out=/results/%s --repeat-interval=%s --duration=%s",
+		name, queryType, fileName, interval, duration)
+	return cmd, fileName
+}
+
+// validateDNSConvergence fetches the dnsProbeSnapshot series written to fileName and asserts that
+// the answer set converges to exactly wantIPs (as a set) within `within` of the series starting,
+// and stays converged for every later snapshot. seriesInterval/seriesDuration must match the
+// values createDNSProbeSeriesCommand was called with, so this can wait for the series to actually
+// finish writing its last snapshot instead of returning as soon as the result file first appears.
+func validateDNSConvergence(f *framework.Framework, pod *v1.Pod, fileName string, wantIPs []string, within, seriesInterval, seriesDuration time.Duration) {
+	ginkgo.By("submitting the pod to kubernetes")
+	podClient := f.ClientSet.CoreV1().Pods(f.Namespace.Name)
+	defer func() {
+		ginkgo.By("deleting the pod")
+		defer ginkgo.GinkgoRecover()
+		podClient.Delete(pod.Name, metav1.NewDeleteOptions(0))
+	}()
+	if _, err := podClient.Create(pod); err != nil {
+		framework.Failf("failed to create pod %s: %v", pod.Name, err)
+	}
+	framework.ExpectNoError(f.WaitForPodRunning(pod.Name))
+
+	wantSnapshots := int(seriesDuration / seriesInterval)
+	snapshots := waitForDNSProbeSeries(f, pod, fileName, wantSnapshots, seriesDuration+time.Minute)
+
+	want := map[string]bool{}
+	for _, ip := range wantIPs {
+		want[ip] = true
+	}
+
+	converged := false
+	for _, snapshot := range snapshots {
+		if answerSetEquals(snapshot.Result.Answers, want) {
+			if !converged {
+				converged = true
+				if time.Duration(snapshot.ElapsedSeconds)*time.Second > within {
+					framework.Failf("DNS answers for %s only converged to %v after %ds, want within %s", fileName, wantIPs, snapshot.ElapsedSeconds, within)
+				}
+			}
+			continue
+		}
+		if converged {
+			framework.Failf("DNS answers for %s regressed away from %v at %ds: %+v", fileName, wantIPs, snapshot.ElapsedSeconds, snapshot.Result.Answers)
+		}
+	}
+	if !converged {
+		framework.Failf("DNS answers for %s never converged to %v across %d snapshots", fileName, wantIPs, len(snapshots))
+	}
+}
+
+// waitForDNSProbeSeries polls the probe pod's result file over its proxy subresource until it
+// parses as a dnsProbeSnapshot array with at least wantSnapshots entries, i.e. until the series has
+// actually finished running for its full configured duration rather than just started writing.
+// Returns the full snapshot series once it does.
+func waitForDNSProbeSeries(f *framework.Framework, pod *v1.Pod, fileName string, wantSnapshots int, timeout time.Duration) []dnsProbeSnapshot {
+	var snapshots []dnsProbeSnapshot
+	framework.ExpectNoError(wait.Poll(5*time.Second, timeout, func() (bool, error) {
+		contents, err := f.ClientSet.CoreV1().RESTClient().Get().
+			Namespace(pod.Namespace).
+			Resource("pods").
+			SubResource("proxy").
+			Name(pod.Name).
+			Suffix("results", fileName).
+			Do().Raw()
+		if err != nil {
+			return false, nil
+		}
+		var parsed []dnsProbeSnapshot
+		if err := json.Unmarshal(contents, &parsed); err != nil {
+			return false, nil
+		}
+		snapshots = parsed
+		return len(snapshots) >= wantSnapshots, nil
+	}), "DNS probe series %s never produced the expected %d snapshots", fileName, wantSnapshots)
+	return snapshots
+}
+
+func answerSetEquals(answers []dnsProbeAnswer, want map[string]bool) bool {
+	if len(answers) != len(want) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, a := range answers {
+		if !want[a.Value] {
+			return false
+		}
+		seen[a.Value] = true
+	}
+	return len(seen) == len(want)
+}
+
+// createDNSProbePod builds a pod that runs probeCmd using the agnhost image's own Go DNS client,
+// writing its result under /results where a sibling agnhost webserver container serves it,
+// exactly like createDNSPod does for the shell-based probers.
+func createDNSProbePod(namespace, probeCmd, podHostName, serviceName string) *v1.Pod {
+	return &v1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dns-probe-test-" + rand.String(5),
+			Namespace: namespace,
+		},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{Name: "results", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+			},
+			Containers: []v1.Container{
+				{
+					Name:         "webserver",
+					Image:        imageutils.GetE2EImage(imageutils.Agnhost),
+					Args:         []string{"test-webserver"},
+					Ports:        []v1.ContainerPort{{ContainerPort: 80}},
+					VolumeMounts: []v1.VolumeMount{{Name: "results", MountPath: "/results"}},
+				},
+				{
+					Name:         "prober",
+					Image:        imageutils.GetE2EImage(imageutils.Agnhost),
+					Command:      []string{"sh", "-c", probeCmd},
+					VolumeMounts: []v1.VolumeMount{{Name: "results", MountPath: "/results"}},
+				},
+			},
+			RestartPolicy: v1.RestartPolicyNever,
+			Hostname:      podHostName,
+			Subdomain:     serviceName,
+		},
+	}
+}
+
+// validateDNSResultsStructured polls for fileName to appear on pod, parses it as a dnsProbeResult,
+// and returns it for the caller to assert against (rcode, record types, TTLs, answer counts).
+func validateDNSResultsStructured(f *framework.Framework, pod *v1.Pod, fileName string) *dnsProbeResult {
+	runProbePod(f, pod, []string{fileName}, "")
+
+	contents, err := f.ClientSet.CoreV1().RESTClient().Get().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		SubResource("proxy").
+		Name(pod.Name).
+		Suffix("results", fileName).
+		Do().Raw()
+	framework.ExpectNoError(err, "failed to fetch structured DNS probe result %s", fileName)
+
+	result := &dnsProbeResult{}
+	if err := json.Unmarshal(contents, result); err != nil {
+		framework.Failf("failed to parse structured DNS probe result %s: %v\ncontents: %s", fileName, err, contents)
+	}
+	return result
+}
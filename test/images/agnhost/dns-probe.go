@@ -0,0 +1,207 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(CmdDNSProbe)
+}
+
+// CmdDNSProbe is used by agnhost Cobra.
+var CmdDNSProbe = &cobra.Command{
+	Use:   "dns-probe",
+	Short: "Issues DNS queries with the Go DNS client and records structured results",
+	Long: `Replaces the dig/nslookup shell probes historically used by the DNS e2e suite with a
+Go-native client (github.com/miekg/dns), so tests can assert on rcode, full answer sets
+(including TTLs), response size, and which transport (UDP vs TCP-after-truncation) was used —
+none of which is reliably scriptable out of dig's text output.
+
+With --repeat-interval and --duration, the probe queries repeatedly and writes a JSON array of
+timestamped snapshots instead of a single result, so tests can observe DNS answers converging
+after endpoint churn or a negative answer expiring from cache.`,
+	Args: cobra.NoArgs,
+	Run:  dnsProbeMain,
+}
+
+var (
+	dnsProbeName           string
+	dnsProbeType           string
+	dnsProbeOut            string
+	dnsProbeRepeatInterval time.Duration
+	dnsProbeDuration       time.Duration
+)
+
+func init() {
+	CmdDNSProbe.Flags().StringVar(&dnsProbeName, "name", "", "name to resolve")
+	CmdDNSProbe.Flags().StringVar(&dnsProbeType, "type", "A", "record type to query (A, AAAA, SRV, CNAME)")
+	CmdDNSProbe.Flags().StringVar(&dnsProbeOut, "out", "", "file to write the JSON result (or result series) to")
+	CmdDNSProbe.Flags().DurationVar(&dnsProbeRepeatInterval, "repeat-interval", 0, "if set along with --duration, repeat the query on this interval")
+	CmdDNSProbe.Flags().DurationVar(&dnsProbeDuration, "duration", 0, "if set along with --repeat-interval, keep probing for this long")
+}
+
+// dnsProbeAnswer mirrors the schema test/e2e/network/dns_probe.go parses.
+type dnsProbeAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   int    `json:"ttl"`
+	Value string `json:"value"`
+}
+
+type dnsProbeResult struct {
+	Question     string           `json:"question"`
+	QueryType    string           `json:"queryType"`
+	Rcode        string           `json:"rcode"`
+	Answers      []dnsProbeAnswer `json:"answers"`
+	ResponseSize int              `json:"responseSize"`
+	Transport    string           `json:"transport"`
+	NegativeTTL  int              `json:"negativeTTL,omitempty"`
+	LatencyNanos int64            `json:"latencyNanos"`
+	Error        string           `json:"error,omitempty"`
+}
+
+type dnsProbeSnapshot struct {
+	ElapsedSeconds int            `json:"elapsedSeconds"`
+	Result         dnsProbeResult `json:"result"`
+}
+
+func dnsProbeMain(cmd *cobra.Command, args []string) {
+	if dnsProbeName == "" || dnsProbeOut == "" {
+		log.Fatal("--name and --out are required")
+	}
+
+	if dnsProbeRepeatInterval <= 0 || dnsProbeDuration <= 0 {
+		result := runDNSProbe(dnsProbeName, dnsProbeType)
+		writeJSON(dnsProbeOut, result)
+		return
+	}
+
+	start := time.Now()
+	var snapshots []dnsProbeSnapshot
+	ticker := time.NewTicker(dnsProbeRepeatInterval)
+	defer ticker.Stop()
+	for {
+		result := runDNSProbe(dnsProbeName, dnsProbeType)
+		snapshots = append(snapshots, dnsProbeSnapshot{
+			ElapsedSeconds: int(time.Since(start).Seconds()),
+			Result:         *result,
+		})
+		writeJSON(dnsProbeOut, snapshots)
+		if time.Since(start) >= dnsProbeDuration {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// runDNSProbe issues a single query for name/queryType against the first nameserver configured
+// in /etc/resolv.conf, following the same UDP-then-TCP-on-truncation fallback glibc's resolver uses.
+func runDNSProbe(name, queryType string) *dnsProbeResult {
+	result := &dnsProbeResult{Question: name, QueryType: queryType}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(queryType)]
+	if !ok {
+		result.Rcode = "ERROR"
+		result.Error = fmt.Sprintf("unknown query type %q", queryType)
+		return result
+	}
+
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		result.Rcode = "ERROR"
+		result.Error = fmt.Sprintf("failed to read /etc/resolv.conf: %v", err)
+		return result
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = true
+
+	client := new(dns.Client)
+	server := conf.Servers[0] + ":" + conf.Port
+
+	start := time.Now()
+	resp, _, err := client.Exchange(msg, server)
+	result.Transport = "udp"
+	if err == nil && resp != nil && resp.Truncated {
+		tcpClient := &dns.Client{Net: "tcp"}
+		resp, _, err = tcpClient.Exchange(msg, server)
+		result.Transport = "tcp"
+	}
+	result.LatencyNanos = time.Since(start).Nanoseconds()
+
+	if err != nil {
+		result.Rcode = "TIMEOUT"
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Rcode = dns.RcodeToString[resp.Rcode]
+	result.ResponseSize = resp.Len()
+
+	for _, rr := range resp.Answer {
+		header := rr.Header()
+		answer := dnsProbeAnswer{
+			Name: header.Name,
+			Type: dns.TypeToString[header.Rrtype],
+			TTL:  int(header.Ttl),
+		}
+		switch v := rr.(type) {
+		case *dns.A:
+			answer.Value = v.A.String()
+		case *dns.AAAA:
+			answer.Value = v.AAAA.String()
+		case *dns.CNAME:
+			answer.Value = v.Target
+		case *dns.SRV:
+			answer.Value = fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target)
+		default:
+			answer.Value = rr.String()
+		}
+		result.Answers = append(result.Answers, answer)
+	}
+
+	if result.Rcode == "NXDOMAIN" {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				result.NegativeTTL = int(soa.Minttl)
+			}
+		}
+	}
+
+	return result
+}
+
+func writeJSON(path string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("failed to marshal DNS probe result: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Fatalf("failed to write DNS probe result to %s: %v", path, err)
+	}
+}